@@ -0,0 +1,171 @@
+// Copyright (c) 2019 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kata-containers/runtime/virtcontainers/factory"
+	"github.com/kata-containers/runtime/virtcontainers/factory/introspectrpc"
+	"github.com/urfave/cli"
+)
+
+var factorySocketFlag = cli.StringFlag{
+	Name:  "socket",
+	Value: introspectrpc.DefaultSocket,
+	Usage: "unix socket the runtime's shim is listening for factory introspection requests on",
+}
+
+// runningFactory reaches the factory the running shim built: first by
+// checking this process's own package-level state (set when something in
+// this same process, such as a test, called factory.NewFactory directly),
+// and otherwise by dialing the shim's introspection socket, the same way
+// grpccache dials VMCacheEndpoint to reach a separate cache process.
+func runningFactory(socket string) (factory.Introspectable, error) {
+	if f := factory.RunningFactory(); f != nil {
+		return f, nil
+	}
+
+	return introspectrpc.Dial(socket)
+}
+
+var factoryListCommand = cli.Command{
+	Name:  "list",
+	Usage: "list the VMs currently held by the running runtime's factory",
+	Flags: []cli.Flag{
+		factorySocketFlag,
+		cli.StringFlag{
+			Name:  "format",
+			Value: "table",
+			Usage: "select the format used to display the list: table or json",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		f, err := runningFactory(c.String("socket"))
+		if err != nil {
+			return err
+		}
+
+		vms, err := f.List(context.Background())
+		if err != nil {
+			return err
+		}
+
+		if c.String("format") == "json" {
+			return json.NewEncoder(os.Stdout).Encode(vms)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 2, 2, 2, ' ', 0)
+		fmt.Fprintln(w, "BACKEND\tHASH\tSTATE\tCID\tPID\tVCPUS\tMEMORY\tPOOL POS\tCREATED")
+		for _, vm := range vms {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\n",
+				vm.Backend, vm.Hash, vm.State, vm.CID, vm.PID, vm.NumVCPUs, vm.MemorySize, vm.PoolPosition,
+				vm.CreatedAt.Format(time.RFC3339))
+		}
+		return w.Flush()
+	},
+}
+
+var factoryPruneCommand = cli.Command{
+	Name:  "prune",
+	Usage: "evict warm factory VMs older than --older-than whose base config is stale",
+	Flags: []cli.Flag{
+		factorySocketFlag,
+		cli.DurationFlag{
+			Name:  "older-than",
+			Value: time.Hour,
+			Usage: "evict warm VMs idle longer than this",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		f, err := runningFactory(c.String("socket"))
+		if err != nil {
+			return err
+		}
+
+		n, err := f.Prune(context.Background(), c.Duration("older-than"))
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stdout, "pruned %d VM(s)\n", n)
+		return nil
+	},
+}
+
+var factoryStatsCommand = cli.Command{
+	Name:  "stats",
+	Usage: "show how many sandboxes each factory backend has served",
+	Flags: []cli.Flag{
+		factorySocketFlag,
+		cli.StringFlag{
+			Name:  "format",
+			Value: "table",
+			Usage: "select the format used to display the stats: table or json",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		f, err := runningFactory(c.String("socket"))
+		if err != nil {
+			return err
+		}
+
+		stats := f.Stats()
+
+		if c.String("format") == "json" {
+			return json.NewEncoder(os.Stdout).Encode(stats)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 2, 2, 2, ' ', 0)
+		fmt.Fprintln(w, "BACKEND\tSERVED")
+		for name, s := range stats {
+			fmt.Fprintf(w, "%s\t%d\n", name, s.Served)
+		}
+		return w.Flush()
+	},
+}
+
+var factoryProbeCommand = cli.Command{
+	Name:  "probe",
+	Usage: "re-validate every factory backend and drop any that stopped being usable",
+	Flags: []cli.Flag{
+		factorySocketFlag,
+	},
+	Action: func(c *cli.Context) error {
+		f, err := runningFactory(c.String("socket"))
+		if err != nil {
+			return err
+		}
+
+		dropped := f.Probe(context.Background())
+		if len(dropped) == 0 {
+			fmt.Fprintln(os.Stdout, "all backends still usable")
+			return nil
+		}
+
+		fmt.Fprintf(os.Stdout, "dropped %d backend(s): %v\n", len(dropped), dropped)
+		return nil
+	},
+}
+
+var factoryCLICommand = cli.Command{
+	Name:  "factory",
+	Usage: "inspect and manage the VM factory warm pool",
+	Subcommands: []cli.Command{
+		factoryListCommand,
+		factoryPruneCommand,
+		factoryStatsCommand,
+		factoryProbeCommand,
+	},
+	Action: func(c *cli.Context) error {
+		return cli.ShowSubcommandHelp(c)
+	},
+}
@@ -0,0 +1,382 @@
+// Copyright (c) 2019 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package cache
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	vc "github.com/kata-containers/runtime/virtcontainers"
+	"github.com/kata-containers/runtime/virtcontainers/factory/base"
+	"github.com/kata-containers/runtime/virtcontainers/factory/configcheck"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var adaptiveLog = logrus.WithField("subsystem", "factory/cache/adaptive")
+
+var (
+	cacheSizeGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "factory_cache_size",
+		Help: "Number of warm VMs currently held in the adaptive factory cache.",
+	})
+	cacheWaitSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "factory_cache_wait_seconds",
+		Help: "Time GetBaseVM callers spent waiting for a warm VM from the adaptive factory cache.",
+	})
+	cacheMissTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "factory_cache_miss_total",
+		Help: "GetBaseVM calls against the adaptive factory cache that found the pool empty.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(cacheSizeGauge, cacheWaitSeconds, cacheMissTotal)
+}
+
+// AdaptiveConfig bounds and tunes an adaptive cache pool.
+type AdaptiveConfig struct {
+	// Min and Max bound how many warm VMs the pool keeps.
+	Min, Max uint
+
+	// TargetWait is the p99 GetBaseVM wait time the controller sizes the
+	// pool to stay under.
+	TargetWait time.Duration
+
+	// Window is how often the controller re-evaluates the pool size.
+	Window time.Duration
+}
+
+type warmVM struct {
+	vm        *vc.VM
+	config    vc.VMConfig
+	createdAt time.Time
+}
+
+// adaptiveCache is a base.FactoryBase that keeps a pool of warm VMs built
+// from an inner backend, growing or shrinking it between AdaptiveConfig.Min
+// and .Max by observing GetBaseVM's inter-arrival rate and miss ratio.
+type adaptiveCache struct {
+	inner base.FactoryBase
+	cfg   AdaptiveConfig
+
+	mu       sync.Mutex
+	pool     *list.List // of *warmVM, oldest first
+	lastGet  time.Time
+	arrivals float64 // EWMA of inter-arrival time, in seconds
+	gets     uint
+	hits     uint
+	misses   uint
+
+	// windowSize is the pool size as of the last rebalance, i.e. the
+	// capacity hits/windowSize measures utilization against for the
+	// window currently being accumulated.
+	windowSize uint
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// NewAdaptive wraps inner in a cache whose warm pool size tracks the
+// observed GetBaseVM call rate instead of staying fixed, targeting
+// cfg.TargetWait while staying within [cfg.Min, cfg.Max].
+func NewAdaptive(ctx context.Context, cfg AdaptiveConfig, inner base.FactoryBase) (base.FactoryBase, error) {
+	if cfg.Max < cfg.Min {
+		return nil, errInvalidBounds(cfg)
+	}
+
+	if cfg.Window <= 0 {
+		cfg.Window = 30 * time.Second
+	}
+
+	c := &adaptiveCache{
+		inner:  inner,
+		cfg:    cfg,
+		pool:   list.New(),
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+
+	for i := uint(0); i < cfg.Min; i++ {
+		if err := c.fill(ctx); err != nil {
+			adaptiveLog.WithError(err).Warn("failed to pre-warm adaptive cache")
+			break
+		}
+	}
+	c.windowSize = uint(c.pool.Len())
+
+	go c.controlLoop(ctx)
+
+	return c, nil
+}
+
+type errInvalidBounds AdaptiveConfig
+
+func (e errInvalidBounds) Error() string {
+	return "cache: MaxCache must be >= MinCache"
+}
+
+// Config returns the inner backend's VM configuration.
+func (c *adaptiveCache) Config() vc.VMConfig {
+	return c.inner.Config()
+}
+
+func (c *adaptiveCache) fill(ctx context.Context) error {
+	vm, err := c.inner.GetBaseVM(ctx, c.inner.Config())
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.pool.PushBack(&warmVM{vm: vm, config: c.inner.Config(), createdAt: time.Now()})
+	cacheSizeGauge.Set(float64(c.pool.Len()))
+	c.mu.Unlock()
+
+	return nil
+}
+
+// GetBaseVM returns a warm VM from the pool if one is available and still
+// matches the inner backend's current config, otherwise it blocks building
+// one fresh from the inner backend and counts the call as a cache miss for
+// the controller. Pooled VMs left stale by a runtime config hot-reload are
+// stopped and skipped here as they're found, rather than being handed out
+// until a separate Prune call happens to run.
+func (c *adaptiveCache) GetBaseVM(ctx context.Context, config vc.VMConfig) (*vc.VM, error) {
+	start := time.Now()
+	current := c.inner.Config()
+
+	c.mu.Lock()
+	c.recordArrival(start)
+
+	for {
+		front := c.pool.Front()
+		if front == nil {
+			break
+		}
+
+		w := front.Value.(*warmVM)
+		c.pool.Remove(front)
+		cacheSizeGauge.Set(float64(c.pool.Len()))
+
+		if configcheck.Equal(w.config, current) != nil {
+			c.mu.Unlock()
+			if err := w.vm.Stop(); err != nil {
+				adaptiveLog.WithError(err).Warn("failed to stop stale pooled VM")
+			}
+			c.mu.Lock()
+			continue
+		}
+
+		c.hits++
+		c.mu.Unlock()
+		cacheWaitSeconds.Observe(time.Since(start).Seconds())
+		return w.vm, nil
+	}
+
+	c.misses++
+	c.mu.Unlock()
+
+	cacheMissTotal.Inc()
+	vm, err := c.inner.GetBaseVM(ctx, config)
+	cacheWaitSeconds.Observe(time.Since(start).Seconds())
+
+	return vm, err
+}
+
+// recordArrival updates the EWMA of GetBaseVM inter-arrival time. Caller
+// must hold c.mu.
+func (c *adaptiveCache) recordArrival(now time.Time) {
+	c.gets++
+	if c.lastGet.IsZero() {
+		c.lastGet = now
+		return
+	}
+
+	const alpha = 0.2
+	gap := now.Sub(c.lastGet).Seconds()
+	c.lastGet = now
+
+	if c.arrivals == 0 {
+		c.arrivals = gap
+		return
+	}
+
+	c.arrivals = alpha*gap + (1-alpha)*c.arrivals
+}
+
+// controlLoop periodically resizes the pool toward a size that should keep
+// GetBaseVM's wait time under cfg.TargetWait, given the observed arrival
+// rate, while staying within [cfg.Min, cfg.Max].
+func (c *adaptiveCache) controlLoop(ctx context.Context) {
+	defer close(c.doneCh)
+
+	ticker := time.NewTicker(c.cfg.Window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stopCh:
+			return
+		case <-ticker.C:
+			c.rebalance(ctx)
+		}
+	}
+}
+
+func (c *adaptiveCache) rebalance(ctx context.Context) {
+	c.mu.Lock()
+	size := uint(c.pool.Len())
+	misses := c.misses
+	hits := c.hits
+	windowSize := c.windowSize
+	arrivalRate := 0.0
+	if c.arrivals > 0 {
+		arrivalRate = 1 / c.arrivals
+	}
+	c.misses = 0
+	c.hits = 0
+	c.gets = 0
+	c.mu.Unlock()
+
+	target := size
+	switch {
+	case misses > 0:
+		// At least one caller had to wait on a fresh VM this window:
+		// grow enough to absorb the observed rate within TargetWait.
+		want := uint(math.Ceil(arrivalRate * c.cfg.TargetWait.Seconds()))
+		if want > size {
+			target = want
+		} else {
+			target = size + 1
+		}
+	case windowSize > 0 && float64(hits)/float64(windowSize) < 0.5:
+		// Fewer than half of the warm VMs available at the start of this
+		// window were actually handed out: shrink by one.
+		if size > 0 {
+			target = size - 1
+		}
+	}
+
+	if target < c.cfg.Min {
+		target = c.cfg.Min
+	}
+	if target > c.cfg.Max {
+		target = c.cfg.Max
+	}
+
+	for uint(c.poolLen()) < target {
+		if err := c.fill(ctx); err != nil {
+			adaptiveLog.WithError(err).Warn("failed to grow adaptive cache")
+			break
+		}
+	}
+
+	for uint(c.poolLen()) > target {
+		if !c.dropOne() {
+			break
+		}
+	}
+
+	c.mu.Lock()
+	c.windowSize = uint(c.pool.Len())
+	c.mu.Unlock()
+
+	adaptiveLog.WithField("size", c.poolLen()).WithField("target", target).Debug("adaptive cache rebalanced")
+}
+
+func (c *adaptiveCache) poolLen() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.pool.Len()
+}
+
+// dropOne stops and removes the oldest pooled VM, returning false if the
+// pool was already empty.
+func (c *adaptiveCache) dropOne() bool {
+	c.mu.Lock()
+	front := c.pool.Front()
+	if front == nil {
+		c.mu.Unlock()
+		return false
+	}
+	c.pool.Remove(front)
+	cacheSizeGauge.Set(float64(c.pool.Len()))
+	c.mu.Unlock()
+
+	w := front.Value.(*warmVM)
+	if err := w.vm.Stop(); err != nil {
+		adaptiveLog.WithError(err).Warn("failed to stop evicted cache VM")
+	}
+
+	return true
+}
+
+// Prune drains every pooled VM older than olderThan whose config no longer
+// matches the inner backend's current config, i.e. VMs built before a
+// runtime config hot-reload. It returns how many were evicted.
+func (c *adaptiveCache) Prune(ctx context.Context, olderThan time.Duration) (int, error) {
+	current := c.inner.Config()
+	cutoff := time.Now().Add(-olderThan)
+
+	c.mu.Lock()
+	var stale []*list.Element
+	for e := c.pool.Front(); e != nil; e = e.Next() {
+		w := e.Value.(*warmVM)
+		if w.createdAt.Before(cutoff) && configcheck.Equal(w.config, current) != nil {
+			stale = append(stale, e)
+		}
+	}
+	for _, e := range stale {
+		c.pool.Remove(e)
+	}
+	cacheSizeGauge.Set(float64(c.pool.Len()))
+	c.mu.Unlock()
+
+	for _, e := range stale {
+		w := e.Value.(*warmVM)
+		if err := w.vm.Stop(); err != nil {
+			adaptiveLog.WithError(err).Warn("failed to stop stale cache VM")
+		}
+	}
+
+	return len(stale), nil
+}
+
+// List returns metadata for every warm VM currently pooled, in pool order.
+func (c *adaptiveCache) List(ctx context.Context) ([]vc.VMInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	infos := make([]vc.VMInfo, 0, c.pool.Len())
+	pos := 0
+	for e := c.pool.Front(); e != nil; e = e.Next() {
+		w := e.Value.(*warmVM)
+		infos = append(infos, vc.VMInfo{
+			CreatedAt:    w.createdAt,
+			State:        "paused",
+			PoolPosition: pos,
+		})
+		pos++
+	}
+
+	return infos, nil
+}
+
+// CloseFactory stops the controller loop, drains the pool and closes the
+// inner backend.
+func (c *adaptiveCache) CloseFactory(ctx context.Context) {
+	close(c.stopCh)
+	<-c.doneCh
+
+	for c.dropOne() {
+	}
+
+	c.inner.CloseFactory(ctx)
+}
@@ -0,0 +1,257 @@
+// Copyright (c) 2019 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+// Package clone implements a vm factory base that keeps a single
+// long-running "golden" VM around and serves GetBaseVM requests by cloning
+// it: the child shares the golden VM's root disk through a copy-on-write
+// overlay and boots with its own fresh scratch layer, rather than restoring
+// a suspended snapshot the way the template factory does.
+package clone
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	vc "github.com/kata-containers/runtime/virtcontainers"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/sirupsen/logrus"
+)
+
+var cloneLog = logrus.WithField("subsystem", "factory/clone")
+
+func trace(parent context.Context, name string) (opentracing.Span, context.Context) {
+	span, ctx := opentracing.StartSpanFromContext(parent, name)
+
+	span.SetTag("subsystem", "factory/clone")
+	span.SetTag("type", "clone")
+
+	return span, ctx
+}
+
+// clone is a vm factory base implementation which keeps one golden VM paused
+// in memory and produces lightweight clones of it on demand.
+type clone struct {
+	sync.Mutex
+
+	config vc.VMConfig
+	golden *vc.VM
+
+	overlayDir string
+	cloneCount uint64
+
+	// overlays maps a cloned VM's ID to the overlay file it was booted
+	// from, so ReleaseVM can remove just that one file instead of
+	// waiting for CloseFactory to wipe overlayDir wholesale.
+	overlays map[string]string
+}
+
+// New creates a new clone factory base. It boots and pauses the golden VM
+// that every subsequent GetBaseVM call will clone from.
+func New(ctx context.Context, config vc.VMConfig) (*clone, error) {
+	span, ctx := trace(ctx, "New")
+	defer span.Finish()
+
+	if config.HypervisorConfig.ImagePath == "" {
+		return nil, fmt.Errorf("clone factory requires a golden VM booted from a disk image")
+	}
+
+	overlayDir, err := os.MkdirTemp(config.HypervisorConfig.VMStorePath, "clone-")
+	if err != nil {
+		return nil, err
+	}
+
+	goldenConfig := config
+	goldenConfig.HypervisorConfig.BootToBeTemplate = false
+	goldenConfig.HypervisorConfig.BootFromTemplate = false
+
+	vm, err := vc.NewVM(ctx, goldenConfig)
+	if err != nil {
+		os.RemoveAll(overlayDir)
+		return nil, err
+	}
+
+	if err := vm.Pause(); err != nil {
+		vm.Stop()
+		os.RemoveAll(overlayDir)
+		return nil, err
+	}
+
+	cloneLog.WithField("golden-vm", vm.ID()).Info("golden VM ready")
+
+	return &clone{
+		config:     config,
+		golden:     vm,
+		overlayDir: overlayDir,
+		overlays:   make(map[string]string),
+	}, nil
+}
+
+// Config returns the configuration passed to New, unchanged. The golden VM
+// itself was booted from a copy with the template boot flags cleared, which
+// checkVMConfig discounts when comparing configs.
+func (c *clone) Config() vc.VMConfig {
+	return c.config
+}
+
+// GetBaseVM clones the golden VM: a fresh copy-on-write overlay is created
+// over its root disk, and a brand new VM is booted (not resumed) on top of
+// that overlay with its own MAC, UUID and vsock CID.
+//
+// The child is always booted at the golden VM's own NumVCPUs/MemorySize,
+// regardless of what config asks for, and GetVM's shared post-creation step
+// hot-adds the difference afterward, the same way every other backend's
+// base VM gets sized up. Booting the child at config's size directly would
+// double-count that delta, since Config() (used to compute it) keeps
+// reporting the golden VM's original size.
+func (c *clone) GetBaseVM(ctx context.Context, config vc.VMConfig) (*vc.VM, error) {
+	span, ctx := trace(ctx, "GetBaseVM")
+	defer span.Finish()
+
+	overlay, err := c.newOverlay(config.HypervisorConfig.ImagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	childConfig := config
+	childConfig.HypervisorConfig.ImagePath = overlay
+	childConfig.HypervisorConfig.BootToBeTemplate = false
+	childConfig.HypervisorConfig.BootFromTemplate = false
+	childConfig.HypervisorConfig.NumVCPUs = c.config.HypervisorConfig.NumVCPUs
+	childConfig.HypervisorConfig.MemorySize = c.config.HypervisorConfig.MemorySize
+
+	vm, err := vc.NewVM(ctx, childConfig)
+	if err != nil {
+		os.Remove(overlay)
+		return nil, err
+	}
+
+	c.Lock()
+	c.overlays[vm.ID()] = overlay
+	c.Unlock()
+
+	cloneLog.WithFields(logrus.Fields{
+		"golden-vm": c.golden.ID(),
+		"clone-vm":  vm.ID(),
+		"overlay":   overlay,
+	}).Info("cloned VM from golden VM")
+
+	return vm, nil
+}
+
+// ReleaseVM removes the overlay backing the clone VM identified by vmID. The
+// factory calls this once it knows that VM has been stopped, rather than
+// waiting for CloseFactory to wipe overlayDir at runtime shutdown. It is a
+// no-op if vmID names no known clone, so it is safe to call more than once
+// or for a VM this backend didn't produce.
+func (c *clone) ReleaseVM(vmID string) error {
+	c.Lock()
+	overlay, ok := c.overlays[vmID]
+	delete(c.overlays, vmID)
+	c.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	if err := os.Remove(overlay); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove overlay %q for clone VM %s: %v", overlay, vmID, err)
+	}
+
+	return nil
+}
+
+// newOverlay creates a fresh qcow2 copy-on-write overlay backed by base and
+// returns its path. Each clone gets its own overlay so writes never touch
+// the golden VM's disk.
+func (c *clone) newOverlay(base string) (string, error) {
+	baseFormat, err := imageFormat(base)
+	if err != nil {
+		return "", err
+	}
+
+	c.Lock()
+	c.cloneCount++
+	id := c.cloneCount
+	c.Unlock()
+
+	overlay := filepath.Join(c.overlayDir, fmt.Sprintf("overlay-%d.qcow2", id))
+
+	cmd := exec.Command("qemu-img", "create", "-f", "qcow2", "-b", base, "-F", baseFormat, overlay)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to create clone overlay: %v: %s", err, out)
+	}
+
+	return overlay, nil
+}
+
+// qemuImgInfo is the subset of `qemu-img info --output=json` this package
+// reads.
+type qemuImgInfo struct {
+	Format string `json:"format"`
+}
+
+// imageFormat asks qemu-img what format path actually is, rather than
+// assuming qcow2: HypervisorConfig.ImagePath is typically a raw rootfs
+// image, and passing the wrong -F to qemu-img create fails the overlay
+// outright.
+func imageFormat(path string) (string, error) {
+	out, err := exec.Command("qemu-img", "info", "--output=json", path).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to detect format of base image %q: %v", path, err)
+	}
+
+	var info qemuImgInfo
+	if err := json.Unmarshal(out, &info); err != nil {
+		return "", fmt.Errorf("failed to parse qemu-img info for %q: %v", path, err)
+	}
+
+	if info.Format == "" {
+		return "", fmt.Errorf("qemu-img info for %q reported no format", path)
+	}
+
+	return info.Format, nil
+}
+
+// Resume reports that a cloned VM is never paused by this backend: it is
+// booted fresh on top of its overlay, so there is no suspended state for
+// GetVM to resume.
+func (c *clone) Resume() bool {
+	return false
+}
+
+// ReseedRNG reports that a freshly booted VM already seeds its own RNG at
+// boot, so GetVM does not need to reseed it the way it must for a VM
+// restored from a paused template.
+func (c *clone) ReseedRNG() bool {
+	return false
+}
+
+// SyncTime reports that a freshly booted VM already has the correct guest
+// time, unlike a VM resumed from a long-paused snapshot.
+func (c *clone) SyncTime() bool {
+	return false
+}
+
+// CloseFactory stops the golden VM and removes any overlays still on disk.
+func (c *clone) CloseFactory(ctx context.Context) {
+	span, _ := trace(ctx, "CloseFactory")
+	defer span.Finish()
+
+	c.Lock()
+	defer c.Unlock()
+
+	if err := c.golden.Stop(); err != nil {
+		cloneLog.WithError(err).Error("failed to stop golden VM")
+	}
+
+	if err := os.RemoveAll(c.overlayDir); err != nil {
+		cloneLog.WithError(err).Error("failed to remove clone overlays")
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2019 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+// Package configcheck implements the VM config comparison used to decide
+// whether a pooled or cached VM still matches the runtime's current config.
+// It is split out of the factory package so that factory backends such as
+// cache can apply exactly the same rules without importing factory back.
+package configcheck
+
+import (
+	"fmt"
+
+	vc "github.com/kata-containers/runtime/virtcontainers"
+	"github.com/kata-containers/runtime/virtcontainers/utils"
+)
+
+// Reset clears the fields of a hypervisor config that are expected to
+// differ between two otherwise-equivalent VMConfigs (sizing, template/clone
+// state, proxy wiring, per-request device attachments), mutating config in
+// place.
+func Reset(config *vc.VMConfig) {
+	config.DeviceRequests = nil
+	config.HypervisorConfig.NumVCPUs = 0
+	config.HypervisorConfig.MemorySize = 0
+	config.HypervisorConfig.BootToBeTemplate = false
+	config.HypervisorConfig.BootFromTemplate = false
+	config.HypervisorConfig.MemoryPath = ""
+	config.HypervisorConfig.DevicesStatePath = ""
+	config.ProxyType = vc.NoopProxyType
+	config.ProxyConfig = vc.ProxyConfig{}
+}
+
+// Equal reports whether two VM configs are equivalent once the fields Reset
+// clears are discounted. It's important that config1 and config2 are passed
+// by value!
+func Equal(config1, config2 vc.VMConfig) error {
+	if config1.HypervisorType != config2.HypervisorType {
+		return fmt.Errorf("hypervisor type does not match: %s vs. %s", config1.HypervisorType, config2.HypervisorType)
+	}
+
+	if config1.AgentType != config2.AgentType {
+		return fmt.Errorf("agent type does not match: %s vs. %s", config1.AgentType, config2.AgentType)
+	}
+
+	Reset(&config1)
+	Reset(&config2)
+
+	if !utils.DeepCompare(config1, config2) {
+		return fmt.Errorf("hypervisor config does not match, base: %+v. new: %+v", config1, config2)
+	}
+
+	return nil
+}
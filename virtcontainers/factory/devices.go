@@ -0,0 +1,134 @@
+// Copyright (c) 2019 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package factory
+
+import (
+	"fmt"
+	"sync"
+
+	vc "github.com/kata-containers/runtime/virtcontainers"
+)
+
+// DeviceRequest aliases vc.DeviceRequest, the struct added to vc.VMConfig so
+// a caller can describe a host PCI device or a mediated vGPU instance it
+// wants hot-attached to a factory-produced VM before GetVM returns it (PCI
+// BDF, IOMMU group, vGPU mdev UUID, desired guest PCI slot). It is kept as
+// an alias here because leasing and validation of those requests is the
+// factory's job, not the VM's.
+type DeviceRequest = vc.DeviceRequest
+
+// validateDeviceRequests rejects device requests the base factory VM cannot
+// satisfy, for example a template VM that was booted without VFIO support.
+func (f *factory) validateDeviceRequests(devices []DeviceRequest) error {
+	if len(devices) == 0 {
+		return nil
+	}
+
+	if !f.base.Config().HypervisorConfig.EnableVFIO {
+		return fmt.Errorf("factory base VM was not booted with VFIO support, cannot attach %d device(s)", len(devices))
+	}
+
+	for _, d := range devices {
+		if d.BDF == "" && d.VGPUUUID == "" {
+			return fmt.Errorf("device request must set either BDF or VGPUUUID")
+		}
+
+		if d.BDF != "" && d.VGPUUUID != "" {
+			return fmt.Errorf("device request %+v sets both BDF and VGPUUUID", d)
+		}
+	}
+
+	return nil
+}
+
+// attachDevices hotplugs config.DeviceRequests onto vm and leases them, if
+// any were requested. It is shared by GetVM's normal path and its
+// direct-factory fallback path so a device request is honored (or fails
+// loudly) regardless of which path actually produced the VM.
+func (f *factory) attachDevices(vm *vc.VM, config vc.VMConfig) error {
+	if len(config.DeviceRequests) == 0 {
+		return nil
+	}
+
+	f.log().WithField("devices", config.DeviceRequests).Info("hotplugging requested devices")
+	if err := vm.HotplugDevices(config.DeviceRequests); err != nil {
+		return err
+	}
+
+	f.devices.lease(vm, config.DeviceRequests)
+
+	return nil
+}
+
+// deviceLease records which devices the factory hot-attached to a VM, and
+// the VM itself, so they can actually be released back to the host pool if
+// the VM is torn down before the caller gets to release them itself.
+type deviceLease struct {
+	vm      *vc.VM
+	devices []DeviceRequest
+}
+
+// deviceLeases tracks, per VM, which devices the factory hot-attached on its
+// behalf so they can be returned to the host pool if the VM is torn down
+// before the caller gets to release them itself.
+type deviceLeases struct {
+	sync.Mutex
+	byVM map[string]deviceLease
+}
+
+func newDeviceLeases() *deviceLeases {
+	return &deviceLeases{byVM: make(map[string]deviceLease)}
+}
+
+func (l *deviceLeases) lease(vm *vc.VM, devices []DeviceRequest) {
+	if len(devices) == 0 {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.byVM[vm.ID()] = deviceLease{vm: vm, devices: devices}
+}
+
+// release forgets about the lease for vmID and actually returns its devices
+// to the host pool via vm.ReleaseDevices. It is a no-op if vmID has no
+// lease, and safe to call more than once for the same vmID.
+func (l *deviceLeases) release(vmID string) error {
+	l.Lock()
+	lease, ok := l.byVM[vmID]
+	delete(l.byVM, vmID)
+	l.Unlock()
+
+	if !ok || len(lease.devices) == 0 {
+		return nil
+	}
+
+	return lease.vm.ReleaseDevices(lease.devices)
+}
+
+// releaseAll returns every still-leased device to the host pool, used when
+// the factory itself is shutting down, and reports the VM IDs whose devices
+// could not be released.
+func (l *deviceLeases) releaseAll() []string {
+	l.Lock()
+	leases := l.byVM
+	l.byVM = make(map[string]deviceLease)
+	l.Unlock()
+
+	var failed []string
+	for vmID, lease := range leases {
+		if len(lease.devices) == 0 {
+			continue
+		}
+
+		if err := lease.vm.ReleaseDevices(lease.devices); err != nil {
+			failed = append(failed, vmID)
+		}
+	}
+
+	return failed
+}
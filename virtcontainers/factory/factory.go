@@ -8,14 +8,17 @@ package factory
 import (
 	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	vc "github.com/kata-containers/runtime/virtcontainers"
 	"github.com/kata-containers/runtime/virtcontainers/factory/base"
 	"github.com/kata-containers/runtime/virtcontainers/factory/cache"
+	"github.com/kata-containers/runtime/virtcontainers/factory/clone"
+	"github.com/kata-containers/runtime/virtcontainers/factory/configcheck"
 	"github.com/kata-containers/runtime/virtcontainers/factory/direct"
 	"github.com/kata-containers/runtime/virtcontainers/factory/grpccache"
 	"github.com/kata-containers/runtime/virtcontainers/factory/template"
-	"github.com/kata-containers/runtime/virtcontainers/utils"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/sirupsen/logrus"
 )
@@ -26,15 +29,64 @@ var factoryLogger = logrus.FieldLogger(logrus.New())
 type Config struct {
 	Template bool
 
+	// Clone keeps one golden VM running and serves GetVM requests by
+	// cloning it. Mutually exclusive with Template and VMCache.
+	Clone bool
+
 	VMCache         bool
 	Cache           uint
 	VMCacheEndpoint string
 
+	// MinCache, MaxCache, TargetWaitMs and ScaleWindow switch the cache
+	// backend from a fixed-size pool to an adaptive one that grows and
+	// shrinks itself between MinCache and MaxCache VMs, targeting a p99
+	// GetVM wait time of TargetWaitMs, re-evaluated every ScaleWindow.
+	// They are ignored unless MaxCache > 0; Cache is ignored when they
+	// are set.
+	MinCache     uint
+	MaxCache     uint
+	TargetWaitMs uint
+	ScaleWindow  time.Duration
+
 	VMConfig vc.VMConfig
+
+	// Backends, when non-empty, turns NewFactory into a multi-hypervisor
+	// factory: one child factory is built per entry and GetVM routes each
+	// request to whichever child's Config() matches it, per
+	// SelectionPolicy. The rest of this Config (Template, Clone, VMCache,
+	// Cache, VMConfig) is ignored when Backends is set.
+	Backends []Config
+
+	// SelectionPolicy picks which matching backend serves a GetVM request
+	// when Backends is set. Defaults to FirstMatch.
+	SelectionPolicy SelectionPolicy
+}
+
+// hookPolicy is optionally implemented by a base.FactoryBase backend whose
+// VMs do not need every generic post-creation hook that GetVM normally runs
+// against a base VM. A backend that does not implement it gets the
+// historical behaviour: every hook runs.
+type hookPolicy interface {
+	// Resume reports whether GetVM must resume the base VM before
+	// returning it.
+	Resume() bool
+
+	// ReseedRNG reports whether GetVM must reseed the guest RNG before
+	// returning the VM.
+	ReseedRNG() bool
+
+	// SyncTime reports whether GetVM must sync the guest clock before
+	// returning the VM.
+	SyncTime() bool
 }
 
 type factory struct {
 	base base.FactoryBase
+
+	devices *deviceLeases
+
+	servedMu sync.Mutex
+	served   uint64
 }
 
 func trace(parent context.Context, name string) (opentracing.Span, context.Context) {
@@ -47,9 +99,13 @@ func trace(parent context.Context, name string) (opentracing.Span, context.Conte
 
 // NewFactory returns a working factory.
 func NewFactory(ctx context.Context, config Config, fetchOnly bool) (vc.Factory, error) {
-	span, _ := trace(ctx, "NewFactory")
+	span, ctx := trace(ctx, "NewFactory")
 	defer span.Finish()
 
+	if len(config.Backends) > 0 {
+		return newMultiFactory(ctx, config, fetchOnly)
+	}
+
 	err := config.VMConfig.Valid()
 	if err != nil {
 		return nil, err
@@ -59,6 +115,14 @@ func NewFactory(ctx context.Context, config Config, fetchOnly bool) (vc.Factory,
 		return nil, fmt.Errorf("cache factory does not support fetch")
 	}
 
+	if config.Clone && config.Template {
+		return nil, fmt.Errorf("clone and template factory are mutually exclusive")
+	}
+
+	if config.Clone && config.VMCache {
+		return nil, fmt.Errorf("clone and vm cache factory are mutually exclusive")
+	}
+
 	var b base.FactoryBase
 	if config.Template {
 		if fetchOnly {
@@ -72,6 +136,14 @@ func NewFactory(ctx context.Context, config Config, fetchOnly bool) (vc.Factory,
 				return nil, err
 			}
 		}
+	} else if config.Clone {
+		if fetchOnly {
+			return nil, fmt.Errorf("clone factory does not support fetch")
+		}
+		b, err = clone.New(ctx, config.VMConfig)
+		if err != nil {
+			return nil, err
+		}
 	} else if config.VMCache && config.Cache == 0 {
 		b, err = grpccache.New(ctx, config.VMCacheEndpoint)
 		if err != nil {
@@ -81,11 +153,24 @@ func NewFactory(ctx context.Context, config Config, fetchOnly bool) (vc.Factory,
 		b = direct.New(ctx, config.VMConfig)
 	}
 
-	if config.Cache > 0 {
+	if config.MaxCache > 0 {
+		b, err = cache.NewAdaptive(ctx, cache.AdaptiveConfig{
+			Min:        config.MinCache,
+			Max:        config.MaxCache,
+			TargetWait: time.Duration(config.TargetWaitMs) * time.Millisecond,
+			Window:     config.ScaleWindow,
+		}, b)
+		if err != nil {
+			return nil, err
+		}
+	} else if config.Cache > 0 {
 		b = cache.New(ctx, config.Cache, b)
 	}
 
-	return &factory{b}, nil
+	f := &factory{base: b, devices: newDeviceLeases()}
+	setRunningFactory(f)
+
+	return f, nil
 }
 
 // SetLogger sets the logger for the factory.
@@ -101,42 +186,63 @@ func (f *factory) log() *logrus.Entry {
 	return factoryLogger.WithField("subsystem", "factory")
 }
 
-func resetHypervisorConfig(config *vc.VMConfig) {
-	config.HypervisorConfig.NumVCPUs = 0
-	config.HypervisorConfig.MemorySize = 0
-	config.HypervisorConfig.BootToBeTemplate = false
-	config.HypervisorConfig.BootFromTemplate = false
-	config.HypervisorConfig.MemoryPath = ""
-	config.HypervisorConfig.DevicesStatePath = ""
-	config.ProxyType = vc.NoopProxyType
-	config.ProxyConfig = vc.ProxyConfig{}
+// checkVMConfig reports whether two VM configs are equivalent, via the
+// comparison rules in configcheck (shared with the cache backend so a
+// hot-reloaded runtime config is recognized as stale the same way in both
+// places). It's important that config1 and config2 are passed by value!
+func checkVMConfig(config1, config2 vc.VMConfig) error {
+	return configcheck.Equal(config1, config2)
 }
 
-// It's important that baseConfig and newConfig are passed by value!
-func checkVMConfig(config1, config2 vc.VMConfig) error {
-	if config1.HypervisorType != config2.HypervisorType {
-		return fmt.Errorf("hypervisor type does not match: %s vs. %s", config1.HypervisorType, config2.HypervisorType)
-	}
+func (f *factory) checkConfig(config vc.VMConfig) error {
+	baseConfig := f.base.Config()
 
-	if config1.AgentType != config2.AgentType {
-		return fmt.Errorf("agent type does not match: %s vs. %s", config1.AgentType, config2.AgentType)
-	}
+	return checkVMConfig(config, baseConfig)
+}
 
-	// check hypervisor config details
-	resetHypervisorConfig(&config1)
-	resetHypervisorConfig(&config2)
+// vmReleaser is optionally implemented by a base.FactoryBase backend that
+// holds per-VM resources outside the VM itself (e.g. clone's copy-on-write
+// overlay disks) and needs to know when a VM it produced has been stopped so
+// it can release them, instead of only reclaiming them at CloseFactory.
+type vmReleaser interface {
+	ReleaseVM(vmID string) error
+}
 
-	if !utils.DeepCompare(config1, config2) {
-		return fmt.Errorf("hypervisor config does not match, base: %+v. new: %+v", config1, config2)
+// releaseVM releases any devices GetVM leased to vmID and, if f.base holds
+// per-VM resources of its own, tells it to release vmID's too.
+func (f *factory) releaseVM(vmID string) error {
+	err := f.devices.release(vmID)
+
+	if vr, ok := f.base.(vmReleaser); ok {
+		if relErr := vr.ReleaseVM(vmID); relErr != nil && err == nil {
+			err = relErr
+		}
 	}
 
-	return nil
+	return err
 }
 
-func (f *factory) checkConfig(config vc.VMConfig) error {
-	baseConfig := f.base.Config()
+// ReleaseVM tells the factory that the caller is done with the VM identified
+// by vmID and has stopped it, so any devices or backend-private resources
+// (such as a clone backend's overlay disk) leased to it can be released
+// back to the host instead of leaking until CloseFactory runs.
+func (f *factory) ReleaseVM(ctx context.Context, vmID string) error {
+	span, _ := trace(ctx, "ReleaseVM")
+	defer span.Finish()
 
-	return checkVMConfig(config, baseConfig)
+	return f.releaseVM(vmID)
+}
+
+// wantHook reports whether the given hookPolicy hook must run against a base
+// VM produced by f.base. Backends that don't implement hookPolicy (the
+// historical behaviour) always want every hook.
+func (f *factory) wantHook(want func(hookPolicy) bool) bool {
+	hp, ok := f.base.(hookPolicy)
+	if !ok {
+		return true
+	}
+
+	return want(hp)
 }
 
 func (f *factory) validateNewVMConfig(config vc.VMConfig) error {
@@ -148,6 +254,10 @@ func (f *factory) validateNewVMConfig(config vc.VMConfig) error {
 		return fmt.Errorf("Missing proxy type")
 	}
 
+	if err := f.validateDeviceRequests(config.DeviceRequests); err != nil {
+		return err
+	}
+
 	return config.Valid()
 }
 
@@ -166,7 +276,21 @@ func (f *factory) GetVM(ctx context.Context, config vc.VMConfig) (*vc.VM, error)
 	err = f.checkConfig(config)
 	if err != nil {
 		f.log().WithError(err).Info("fallback to direct factory vm")
-		return direct.New(ctx, config).GetBaseVM(ctx, config)
+
+		vm, dErr := direct.New(ctx, config).GetBaseVM(ctx, config)
+		if dErr != nil {
+			return nil, dErr
+		}
+
+		if aErr := f.attachDevices(vm, config); aErr != nil {
+			f.log().WithError(aErr).Error("failed to hotplug requested devices onto fallback vm")
+			vm.Stop()
+			return nil, aErr
+		}
+
+		f.recordServed()
+
+		return vm, nil
 	}
 
 	f.log().Info("get base VM")
@@ -180,25 +304,34 @@ func (f *factory) GetVM(ctx context.Context, config vc.VMConfig) (*vc.VM, error)
 	defer func() {
 		if err != nil {
 			f.log().WithError(err).Error("clean up vm")
+			if relErr := f.releaseVM(vm.ID()); relErr != nil {
+				f.log().WithError(relErr).Error("failed to release devices or backend resources back to the host")
+			}
 			vm.Stop()
 		}
 	}()
 
-	err = vm.Resume()
-	if err != nil {
-		return nil, err
+	if f.wantHook(hookPolicy.Resume) {
+		err = vm.Resume()
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// reseed RNG so that shared memory VMs do not generate same random numbers.
-	err = vm.ReseedRNG()
-	if err != nil {
-		return nil, err
+	if f.wantHook(hookPolicy.ReseedRNG) {
+		err = vm.ReseedRNG()
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// sync guest time since we might have paused it for a long time.
-	err = vm.SyncTime()
-	if err != nil {
-		return nil, err
+	if f.wantHook(hookPolicy.SyncTime) {
+		err = vm.SyncTime()
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	online := false
@@ -226,9 +359,24 @@ func (f *factory) GetVM(ctx context.Context, config vc.VMConfig) (*vc.VM, error)
 		}
 	}
 
+	if err = f.attachDevices(vm, config); err != nil {
+		return nil, err
+	}
+
+	f.recordServed()
+
 	return vm, nil
 }
 
+// recordServed bumps the count Stats reports for this factory's single
+// backend, for a VM GetVM is about to hand back successfully, whichever
+// path (base factory or direct fallback) produced it.
+func (f *factory) recordServed() {
+	f.servedMu.Lock()
+	f.served++
+	f.servedMu.Unlock()
+}
+
 // Config returns base factory config.
 func (f *factory) Config() vc.VMConfig {
 	return f.base.Config()
@@ -241,5 +389,9 @@ func (f *factory) GetBaseVM(ctx context.Context, config vc.VMConfig) (*vc.VM, er
 
 // CloseFactory closes the factory.
 func (f *factory) CloseFactory(ctx context.Context) {
+	for _, vmID := range f.devices.releaseAll() {
+		f.log().WithField("vm", vmID).Error("failed to release devices leaked by an unclosed VM")
+	}
+
 	f.base.CloseFactory(ctx)
 }
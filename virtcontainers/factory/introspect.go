@@ -0,0 +1,221 @@
+// Copyright (c) 2019 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package factory
+
+import (
+	"context"
+	"time"
+
+	vc "github.com/kata-containers/runtime/virtcontainers"
+)
+
+// VMInfo aliases vc.VMInfo, the struct describing a single VM currently held
+// by a factory (base config hash, creation time, state, CID, hypervisor
+// PID, current sizing and, for pooled backends, position in the warm pool).
+// It is kept as an alias here, rather than defined in this package, so that
+// base.FactoryBase implementations such as cache can implement lister and
+// pruner without importing this package back.
+type VMInfo = vc.VMInfo
+
+// lister is optionally implemented by a base.FactoryBase backend that can
+// enumerate the VMs it currently holds. Backends without a notion of
+// multiple held VMs (direct, template) simply don't implement it.
+type lister interface {
+	List(ctx context.Context) ([]VMInfo, error)
+}
+
+// pruner is optionally implemented by a base.FactoryBase backend that keeps
+// a pool of warm VMs and can evict the stale ones.
+type pruner interface {
+	Prune(ctx context.Context, olderThan time.Duration) (int, error)
+}
+
+// Introspectable is implemented by every factory NewFactory returns: both
+// the single-backend and multi-backend cases support listing and pruning
+// the VMs they hold, reporting per-backend stats, and re-probing backend
+// availability, on top of the plain vc.Factory interface.
+type Introspectable interface {
+	vc.Factory
+
+	List(ctx context.Context) ([]VMInfo, error)
+	Prune(ctx context.Context, olderThan time.Duration) (int, error)
+
+	// Stats returns, per backend name, how many sandboxes that backend
+	// has served.
+	Stats() map[string]BackendStats
+
+	// Probe re-validates that every backend this factory was built with
+	// is still usable, dropping any that are not, and returns the names
+	// it dropped.
+	Probe(ctx context.Context) []string
+
+	// ReleaseVM tells the factory that vmID has been stopped by its
+	// owner, so any devices or backend-private resources leased to it
+	// can be released back to the host now instead of at CloseFactory.
+	ReleaseVM(ctx context.Context, vmID string) error
+}
+
+var runningFactory Introspectable
+
+// setRunningFactory records f as the runtime's current factory so other code
+// in this same process can reach it through RunningFactory. It is held in a
+// package-level variable, so a separate process does not see it.
+func setRunningFactory(f Introspectable) {
+	runningFactory = f
+}
+
+// RunningFactory returns the factory most recently built by NewFactory, or
+// nil if none has been built yet.
+func RunningFactory() Introspectable {
+	return runningFactory
+}
+
+// List returns metadata for every VM the factory currently holds. It
+// returns an empty slice, not an error, for backends that hold no more than
+// the single base VM GetBaseVM always returns fresh.
+func (f *factory) List(ctx context.Context) ([]VMInfo, error) {
+	span, ctx := trace(ctx, "List")
+	defer span.Finish()
+
+	l, ok := f.base.(lister)
+	if !ok {
+		return nil, nil
+	}
+
+	return l.List(ctx)
+}
+
+// Prune evicts warm VMs older than olderThan whose base config no longer
+// matches the factory's current runtime config, returning how many were
+// evicted. It is a no-op for backends without a warm pool.
+func (f *factory) Prune(ctx context.Context, olderThan time.Duration) (int, error) {
+	span, ctx := trace(ctx, "Prune")
+	defer span.Finish()
+
+	p, ok := f.base.(pruner)
+	if !ok {
+		return 0, nil
+	}
+
+	return p.Prune(ctx, olderThan)
+}
+
+// Stats returns how many sandboxes this factory has served, keyed by its
+// single backend's hypervisor type, so a single-backend factory satisfies
+// Introspectable the same way a multi-backend one does.
+func (f *factory) Stats() map[string]BackendStats {
+	f.servedMu.Lock()
+	defer f.servedMu.Unlock()
+
+	name := f.base.Config().HypervisorType.String()
+	if name == "" {
+		name = "unknown"
+	}
+
+	return map[string]BackendStats{name: {Served: f.served}}
+}
+
+// Probe is a no-op for a single-backend factory: there is only the one
+// backend NewFactory already confirmed usable, so there is nothing to
+// re-validate or drop.
+func (f *factory) Probe(ctx context.Context) []string {
+	return nil
+}
+
+// List aggregates VMInfo across every child backend, tagging each entry
+// with the backend that produced it.
+func (mf *multiFactory) List(ctx context.Context) ([]VMInfo, error) {
+	span, ctx := trace(ctx, "multiFactory List")
+	defer span.Finish()
+
+	mf.mu.RLock()
+	children := append([]*namedFactory(nil), mf.children...)
+	mf.mu.RUnlock()
+
+	var all []VMInfo
+	for _, nf := range children {
+		l, ok := nf.factory.(lister)
+		if !ok {
+			continue
+		}
+
+		infos, err := l.List(ctx)
+		if err != nil {
+			factoryLogger.WithError(err).WithField("backend", nf.name).Warn("failed to list backend VMs")
+			continue
+		}
+
+		for i := range infos {
+			infos[i].Backend = nf.name
+		}
+		all = append(all, infos...)
+	}
+
+	return all, nil
+}
+
+// ReleaseVM forwards the release to whichever child factory served vmID. It
+// is a no-op, not an error, for a vmID none of the children recorded serving
+// (for example a VM the direct fallback produced).
+func (mf *multiFactory) ReleaseVM(ctx context.Context, vmID string) error {
+	span, ctx := trace(ctx, "multiFactory ReleaseVM")
+	defer span.Finish()
+
+	mf.vmMu.Lock()
+	name, ok := mf.vmBackend[vmID]
+	delete(mf.vmBackend, vmID)
+	mf.vmMu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	mf.mu.RLock()
+	defer mf.mu.RUnlock()
+
+	for _, nf := range mf.children {
+		if nf.name != name {
+			continue
+		}
+
+		ir, ok := nf.factory.(Introspectable)
+		if !ok {
+			return nil
+		}
+
+		return ir.ReleaseVM(ctx, vmID)
+	}
+
+	return nil
+}
+
+// Prune evicts stale warm VMs across every child backend that has a pool,
+// returning the total number evicted.
+func (mf *multiFactory) Prune(ctx context.Context, olderThan time.Duration) (int, error) {
+	span, ctx := trace(ctx, "multiFactory Prune")
+	defer span.Finish()
+
+	mf.mu.RLock()
+	children := append([]*namedFactory(nil), mf.children...)
+	mf.mu.RUnlock()
+
+	total := 0
+	for _, nf := range children {
+		p, ok := nf.factory.(pruner)
+		if !ok {
+			continue
+		}
+
+		n, err := p.Prune(ctx, olderThan)
+		if err != nil {
+			factoryLogger.WithError(err).WithField("backend", nf.name).Warn("failed to prune backend VMs")
+			continue
+		}
+		total += n
+	}
+
+	return total, nil
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2019 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+// Package introspectrpc lets the kata-runtime factory CLI subcommands reach
+// a factory.Introspectable that is running inside a separate shim process,
+// the same way grpccache lets a separate process reach a cache factory's
+// GetBaseVM over VMCacheEndpoint: the shim serves its factory on a unix
+// socket and the CLI dials it. Unlike grpccache this is plain net/rpc
+// rather than grpc/protobuf, since the calls it carries are a handful of
+// simple, internal, same-binary requests that don't justify a generated
+// wire format of their own.
+package introspectrpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"time"
+
+	vc "github.com/kata-containers/runtime/virtcontainers"
+	"github.com/kata-containers/runtime/virtcontainers/factory"
+)
+
+// DefaultSocket is where Serve listens and Dial connects by default, unless
+// the caller picked a different path (for example to run more than one
+// shim on the same host).
+const DefaultSocket = "/run/vc/factory-introspect.sock"
+
+// server adapts a factory.Introspectable to the method-per-RPC shape
+// net/rpc requires.
+type server struct {
+	f factory.Introspectable
+}
+
+type listArgs struct{}
+
+type listReply struct {
+	VMs []factory.VMInfo
+}
+
+func (s *server) List(args listArgs, reply *listReply) error {
+	vms, err := s.f.List(context.Background())
+	if err != nil {
+		return err
+	}
+
+	reply.VMs = vms
+	return nil
+}
+
+type pruneArgs struct {
+	OlderThan time.Duration
+}
+
+type pruneReply struct {
+	Count int
+}
+
+func (s *server) Prune(args pruneArgs, reply *pruneReply) error {
+	n, err := s.f.Prune(context.Background(), args.OlderThan)
+	if err != nil {
+		return err
+	}
+
+	reply.Count = n
+	return nil
+}
+
+type statsArgs struct{}
+
+type statsReply struct {
+	Stats map[string]factory.BackendStats
+}
+
+func (s *server) Stats(args statsArgs, reply *statsReply) error {
+	reply.Stats = s.f.Stats()
+	return nil
+}
+
+type probeArgs struct{}
+
+type probeReply struct {
+	Dropped []string
+}
+
+func (s *server) Probe(args probeArgs, reply *probeReply) error {
+	reply.Dropped = s.f.Probe(context.Background())
+	return nil
+}
+
+type releaseVMArgs struct {
+	VMID string
+}
+
+type releaseVMReply struct{}
+
+func (s *server) ReleaseVM(args releaseVMArgs, reply *releaseVMReply) error {
+	return s.f.ReleaseVM(context.Background(), args.VMID)
+}
+
+// Serve registers f on a fresh net/rpc server and accepts connections on
+// socket until ctx is cancelled. A stale socket left over from a previous,
+// uncleanly-stopped runtime is removed first.
+func Serve(ctx context.Context, socket string, f factory.Introspectable) (net.Listener, error) {
+	os.Remove(socket)
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("introspectrpc: failed to listen on %s: %v", socket, err)
+	}
+
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Introspect", &server{f: f}); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	go srv.Accept(l)
+
+	return l, nil
+}
+
+// client implements factory.Introspectable by calling a server registered
+// via Serve over a net/rpc connection dialed at socket.
+type client struct {
+	rpc *rpc.Client
+}
+
+// Dial connects to the factory.Introspectable a running shim registered via
+// Serve on socket.
+func Dial(socket string) (factory.Introspectable, error) {
+	c, err := rpc.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("introspectrpc: failed to connect to %s: %v (is a runtime listening there?)", socket, err)
+	}
+
+	return &client{rpc: c}, nil
+}
+
+func (c *client) List(ctx context.Context) ([]factory.VMInfo, error) {
+	var reply listReply
+	if err := c.rpc.Call("Introspect.List", listArgs{}, &reply); err != nil {
+		return nil, err
+	}
+
+	return reply.VMs, nil
+}
+
+func (c *client) Prune(ctx context.Context, olderThan time.Duration) (int, error) {
+	var reply pruneReply
+	if err := c.rpc.Call("Introspect.Prune", pruneArgs{OlderThan: olderThan}, &reply); err != nil {
+		return 0, err
+	}
+
+	return reply.Count, nil
+}
+
+func (c *client) Stats() map[string]factory.BackendStats {
+	var reply statsReply
+	if err := c.rpc.Call("Introspect.Stats", statsArgs{}, &reply); err != nil {
+		return nil
+	}
+
+	return reply.Stats
+}
+
+func (c *client) Probe(ctx context.Context) []string {
+	var reply probeReply
+	if err := c.rpc.Call("Introspect.Probe", probeArgs{}, &reply); err != nil {
+		return nil
+	}
+
+	return reply.Dropped
+}
+
+func (c *client) ReleaseVM(ctx context.Context, vmID string) error {
+	var reply releaseVMReply
+	return c.rpc.Call("Introspect.ReleaseVM", releaseVMArgs{VMID: vmID}, &reply)
+}
+
+// Config, GetVM, GetBaseVM and CloseFactory round out vc.Factory, which
+// Introspectable embeds, but the CLI never calls them through a client: a
+// one-shot CLI invocation has no use for building or tearing down VMs, only
+// for inspecting the ones the shim's own factory already holds.
+func (c *client) Config() vc.VMConfig {
+	return vc.VMConfig{}
+}
+
+func (c *client) GetVM(ctx context.Context, config vc.VMConfig) (*vc.VM, error) {
+	return nil, fmt.Errorf("introspectrpc: GetVM is not available over the introspection connection")
+}
+
+func (c *client) GetBaseVM(ctx context.Context, config vc.VMConfig) (*vc.VM, error) {
+	return nil, fmt.Errorf("introspectrpc: GetBaseVM is not available over the introspection connection")
+}
+
+func (c *client) CloseFactory(ctx context.Context) {
+	c.rpc.Close()
+}
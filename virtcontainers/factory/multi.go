@@ -0,0 +1,328 @@
+// Copyright (c) 2019 HyperHQ Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package factory
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	vc "github.com/kata-containers/runtime/virtcontainers"
+	"github.com/kata-containers/runtime/virtcontainers/factory/direct"
+)
+
+// SelectionPolicy controls how a multi-backend factory picks which of its
+// Backends serves a given GetVM request.
+type SelectionPolicy uint
+
+const (
+	// FirstMatch routes to the first backend whose Config() matches the
+	// requested VM config under checkVMConfig.
+	FirstMatch SelectionPolicy = iota
+
+	// LowestLatency routes to the backend with the lowest average
+	// observed GetVM latency among those whose Config() matches,
+	// treating a backend with no served requests yet as having zero
+	// latency so it gets tried at least once.
+	LowestLatency
+
+	// Explicit routes solely on VMConfig.HypervisorType, ignoring the
+	// rest of the config.
+	Explicit
+)
+
+// BackendStats records how many sandboxes a given backend of a
+// multi-backend factory has served and how long those GetVM calls took in
+// total, so operators can see which hypervisor actually handled which
+// sandbox and LowestLatency has something real to rank on.
+type BackendStats struct {
+	Served       uint64
+	TotalLatency time.Duration
+}
+
+// avgLatency returns s's mean GetVM latency, or zero if it hasn't served
+// anything yet.
+func (s BackendStats) avgLatency() time.Duration {
+	if s.Served == 0 {
+		return 0
+	}
+
+	return s.TotalLatency / time.Duration(s.Served)
+}
+
+type namedFactory struct {
+	name    string
+	config  Config
+	factory vc.Factory
+}
+
+// multiFactory fronts several single-hypervisor factories built from
+// Config.Backends and routes each GetVM call to whichever of them matches,
+// falling back to a plain direct.New VM when none do.
+type multiFactory struct {
+	policy    SelectionPolicy
+	fetchOnly bool
+
+	mu       sync.RWMutex
+	children []*namedFactory
+
+	statsMu sync.Mutex
+	stats   map[string]*BackendStats
+
+	// vmBackend remembers which child factory served a given VM ID, so
+	// ReleaseVM knows which child to forward the release to.
+	vmMu      sync.Mutex
+	vmBackend map[string]string
+}
+
+// newMultiFactory probes every configured backend, builds a child factory
+// for each one that is usable, and drops the rest with a log line.
+func newMultiFactory(ctx context.Context, config Config, fetchOnly bool) (vc.Factory, error) {
+	span, ctx := trace(ctx, "newMultiFactory")
+	defer span.Finish()
+
+	mf := &multiFactory{
+		policy:    config.SelectionPolicy,
+		fetchOnly: fetchOnly,
+		stats:     make(map[string]*BackendStats),
+		vmBackend: make(map[string]string),
+	}
+
+	for _, backendConfig := range config.Backends {
+		name := backendName(backendConfig)
+
+		if err := probeBackend(backendConfig); err != nil {
+			factoryLogger.WithError(err).WithField("backend", name).Warn("dropping unavailable factory backend")
+			continue
+		}
+
+		f, err := NewFactory(ctx, backendConfig, fetchOnly)
+		if err != nil {
+			factoryLogger.WithError(err).WithField("backend", name).Warn("dropping unavailable factory backend")
+			continue
+		}
+
+		mf.children = append(mf.children, &namedFactory{name: name, config: backendConfig, factory: f})
+		mf.stats[name] = &BackendStats{}
+	}
+
+	if len(mf.children) == 0 {
+		return nil, fmt.Errorf("no usable factory backend out of %d configured", len(config.Backends))
+	}
+
+	setRunningFactory(mf)
+
+	return mf, nil
+}
+
+func backendName(config Config) string {
+	if config.VMConfig.HypervisorType.String() != "" {
+		return config.VMConfig.HypervisorType.String()
+	}
+
+	return "unknown"
+}
+
+// probeBackend validates that a backend's hypervisor binary and any kernel
+// modules it depends on are present on this host, so NewFactory never
+// spends time booting a golden VM for a hypervisor that cannot run here.
+func probeBackend(config Config) error {
+	path := config.VMConfig.HypervisorConfig.HypervisorPath
+	if path == "" {
+		return fmt.Errorf("no hypervisor binary configured")
+	}
+
+	if _, err := exec.LookPath(path); err != nil {
+		if _, statErr := os.Stat(path); statErr != nil {
+			return fmt.Errorf("hypervisor binary %q not found: %v", path, err)
+		}
+	}
+
+	for _, module := range config.VMConfig.HypervisorConfig.RequiredKernelModules {
+		if _, err := os.Stat(filepath.Join("/sys/module", module)); err != nil {
+			return fmt.Errorf("required kernel module %q not loaded", module)
+		}
+	}
+
+	return nil
+}
+
+// Probe re-validates every backend this factory was built with and drops
+// any that have stopped being usable since NewFactory ran (for example a
+// kernel module was unloaded). It returns the names of the backends it
+// dropped.
+func (mf *multiFactory) Probe(ctx context.Context) []string {
+	span, _ := trace(ctx, "Probe")
+	defer span.Finish()
+
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+
+	var dropped []string
+	var kept []*namedFactory
+	for _, nf := range mf.children {
+		if err := probeBackend(nf.config); err != nil {
+			factoryLogger.WithError(err).WithField("backend", nf.name).Warn("factory backend no longer usable")
+			nf.factory.CloseFactory(ctx)
+			dropped = append(dropped, nf.name)
+			continue
+		}
+		kept = append(kept, nf)
+	}
+
+	mf.children = kept
+
+	return dropped
+}
+
+// Stats returns, per backend name, how many sandboxes that backend has
+// served.
+func (mf *multiFactory) Stats() map[string]BackendStats {
+	mf.statsMu.Lock()
+	defer mf.statsMu.Unlock()
+
+	stats := make(map[string]BackendStats, len(mf.stats))
+	for name, s := range mf.stats {
+		stats[name] = *s
+	}
+
+	return stats
+}
+
+func (mf *multiFactory) recordServed(name string, latency time.Duration) {
+	mf.statsMu.Lock()
+	defer mf.statsMu.Unlock()
+
+	s, ok := mf.stats[name]
+	if !ok {
+		s = &BackendStats{}
+		mf.stats[name] = s
+	}
+	s.Served++
+	s.TotalLatency += latency
+}
+
+// pick selects the child factory that should serve config, per policy.
+func (mf *multiFactory) pick(config vc.VMConfig) (*namedFactory, error) {
+	mf.mu.RLock()
+	defer mf.mu.RUnlock()
+
+	if mf.policy == Explicit {
+		for _, nf := range mf.children {
+			if nf.config.VMConfig.HypervisorType == config.HypervisorType {
+				return nf, nil
+			}
+		}
+		return nil, fmt.Errorf("no factory backend configured for hypervisor type %q", config.HypervisorType)
+	}
+
+	var matches []*namedFactory
+	for _, nf := range mf.children {
+		if err := checkVMConfig(config, nf.factory.Config()); err == nil {
+			matches = append(matches, nf)
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no factory backend config matches the requested VM config")
+	}
+
+	if mf.policy != LowestLatency {
+		return matches[0], nil
+	}
+
+	return mf.lowestLatency(matches), nil
+}
+
+// lowestLatency returns whichever of matches has the lowest average GetVM
+// latency recorded so far, per Stats. A backend that hasn't served anything
+// yet counts as zero latency, so it is picked ahead of any backend that has;
+// among equal latencies the one listed first in matches wins.
+func (mf *multiFactory) lowestLatency(matches []*namedFactory) *namedFactory {
+	stats := mf.Stats()
+
+	best := matches[0]
+	bestLatency := stats[best.name].avgLatency()
+
+	for _, nf := range matches[1:] {
+		latency := stats[nf.name].avgLatency()
+		if latency < bestLatency {
+			best = nf
+			bestLatency = latency
+		}
+	}
+
+	return best
+}
+
+// Config returns the config of the first child factory.
+func (mf *multiFactory) Config() vc.VMConfig {
+	mf.mu.RLock()
+	defer mf.mu.RUnlock()
+
+	if len(mf.children) == 0 {
+		return vc.VMConfig{}
+	}
+
+	return mf.children[0].factory.Config()
+}
+
+// GetVM returns a working blank VM from whichever backend matches config,
+// falling back to a plain direct.New VM if none do.
+func (mf *multiFactory) GetVM(ctx context.Context, config vc.VMConfig) (*vc.VM, error) {
+	span, ctx := trace(ctx, "multiFactory GetVM")
+	defer span.Finish()
+
+	start := time.Now()
+
+	nf, err := mf.pick(config)
+	if err != nil {
+		factoryLogger.WithError(err).Info("fallback to direct factory vm")
+		vm, dErr := direct.New(ctx, config).GetBaseVM(ctx, config)
+		if dErr != nil {
+			return nil, dErr
+		}
+		mf.recordServed("direct", time.Since(start))
+		return vm, nil
+	}
+
+	vm, err := nf.factory.GetVM(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	mf.recordServed(nf.name, time.Since(start))
+
+	mf.vmMu.Lock()
+	mf.vmBackend[vm.ID()] = nf.name
+	mf.vmMu.Unlock()
+
+	return vm, nil
+}
+
+// GetBaseVM returns a paused VM from whichever backend matches config.
+func (mf *multiFactory) GetBaseVM(ctx context.Context, config vc.VMConfig) (*vc.VM, error) {
+	nf, err := mf.pick(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return nf.factory.GetBaseVM(ctx, config)
+}
+
+// CloseFactory closes every child factory.
+func (mf *multiFactory) CloseFactory(ctx context.Context) {
+	mf.mu.RLock()
+	defer mf.mu.RUnlock()
+
+	for _, nf := range mf.children {
+		nf.factory.CloseFactory(ctx)
+	}
+}